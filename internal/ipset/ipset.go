@@ -0,0 +1,91 @@
+// Package ipset provides handling of ipset lists.
+package ipset
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// Manager is the ipset manager interface.
+type Manager interface {
+	// Add adds the given host's resolved IP addresses to the ipsets
+	// according to the configuration.  host must be a domain name in lower
+	// case.  ip4s and ip6s must be valid IPv4 and IPv6 addresses
+	// correspondingly.  ttl is the TTL of the DNS answer the addresses came
+	// from; it is only used for sets that support element timeouts.
+	Add(ctx context.Context, host string, ip4s, ip6s []net.IP, ttl time.Duration) (n int, err error)
+
+	// Flush forces any set-element additions buffered by [Manager.Add] to be
+	// written out immediately, instead of waiting for the next scheduled
+	// flush.  It is primarily useful in tests and during shutdown.
+	Flush(ctx context.Context) (err error)
+
+	// Close closes the ipset manager.
+	Close() (err error)
+}
+
+// Config is the ipset manager configuration.
+type Config struct {
+	// Logger is used for logging the operation of the ipset manager.  It
+	// must not be nil.
+	Logger *slog.Logger `yaml:"-"`
+
+	// Lines are the ipset configuration lines.  Each line has the following
+	// format:
+	//
+	//   "DOMAIN[,DOMAIN].../N#family#table#set[,N#family#table#set]..."
+	//
+	// where N is "4" for IPv4 sets or "6" for IPv6 sets.  A set name may be
+	// followed by a ":443,8443"-style port list and a ";timeout=5m"-style
+	// suffix.
+	Lines []string `yaml:"ipset"`
+
+	// AutoCreateSets, if true, makes the manager create any set referenced
+	// in Lines that does not yet exist in nftables, instead of failing to
+	// start.
+	AutoCreateSets bool `yaml:"ipset_auto_create"`
+
+	// IpsetFlushInterval is the maximum time set-element additions are
+	// buffered before being flushed to nftables.  If zero, a reasonable
+	// default is used.
+	IpsetFlushInterval time.Duration `yaml:"ipset_flush_interval"`
+
+	// IpsetFlushBatchSize is the number of set-element additions pending
+	// for a single set that triggers an immediate flush to nftables,
+	// instead of waiting for IpsetFlushInterval to elapse.  If zero, a
+	// reasonable default is used.
+	IpsetFlushBatchSize int `yaml:"ipset_flush_batch_size"`
+}
+
+// NewManager returns a new Manager.  If conf has no configuration lines, the
+// returned manager is an [EmptyManager].
+func NewManager(ctx context.Context, conf *Config) (m Manager, err error) {
+	if len(conf.Lines) == 0 {
+		return EmptyManager{}, nil
+	}
+
+	return newManager(ctx, conf)
+}
+
+// EmptyManager is a [Manager] that does nothing.
+type EmptyManager struct{}
+
+// type check
+var _ Manager = EmptyManager{}
+
+// Add implements the [Manager] interface for EmptyManager.
+func (EmptyManager) Add(_ context.Context, _ string, _, _ []net.IP, _ time.Duration) (n int, err error) {
+	return 0, nil
+}
+
+// Flush implements the [Manager] interface for EmptyManager.
+func (EmptyManager) Flush(_ context.Context) (err error) {
+	return nil
+}
+
+// Close implements the [Manager] interface for EmptyManager.
+func (EmptyManager) Close() (err error) {
+	return nil
+}
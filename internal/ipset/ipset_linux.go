@@ -5,14 +5,18 @@ package ipset
 import (
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/AdguardTeam/golibs/container"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
 )
 
 // How to test on a real Linux machine:
@@ -29,26 +33,126 @@ import (
 //
 //  6. Run "nft list set inet fw4 example_set". The set should contain the resolved IP addresses.
 
+// ipsetConn is the subset of the [*nftables.Conn] API used by manager.  It
+// exists to allow substituting a fake implementation in tests.
+type ipsetConn interface {
+	GetSetByName(table *nftables.Table, name string) (*nftables.Set, error)
+	AddSet(set *nftables.Set, vals []nftables.SetElement) error
+	SetAddElements(set *nftables.Set, vals []nftables.SetElement) error
+	Flush() error
+	CloseLasting() error
+
+	// MonitorSetElements subscribes to netlink set-element add/delete
+	// notifications.  events is closed once the subscription is torn down,
+	// either via closer.Close or because ctx is canceled.
+	MonitorSetElements(ctx context.Context) (events <-chan setElemEvent, closer io.Closer, err error)
+}
+
+// setElemEvent is a single set-element addition or removal observed via a
+// live netlink subscription, as opposed to one made through this manager.
+type setElemEvent struct {
+	// table and set identify the nftables set the event occurred in.
+	table string
+	set   string
+
+	// key is the raw element key, as in [nftables.SetElement.Key].
+	key []byte
+
+	// deleted is true if the element was removed, false if it was added.
+	deleted bool
+}
+
+// dialFunc opens a new [ipsetConn].  It exists to allow substituting a fake
+// implementation in tests.
+type dialFunc func() (conn ipsetConn, err error)
+
+// Default values for [Config.IpsetFlushInterval] and
+// [Config.IpsetFlushBatchSize].
+const (
+	defaultFlushInterval  = 50 * time.Millisecond
+	defaultFlushBatchSize = 128
+)
+
 // newManager returns a new Linux nftables ipset manager.
 func newManager(ctx context.Context, conf *Config) (set Manager, err error) {
-	defer func() { err = errors.Annotate(err, "ipset: %w") }()
+	return newManagerWithDialer(ctx, conf, dialLasting)
+}
 
-	// Создаем соединение с nftables
+// dialLasting opens a lasting connection to nftables.
+func dialLasting() (conn ipsetConn, err error) {
 	c, err := nftables.New(nftables.AsLasting())
+	if err != nil {
+		return nil, err
+	}
+
+	return &lastingConn{Conn: c}, nil
+}
+
+// lastingConn wraps a lasting *[nftables.Conn] to additionally implement the
+// live set-element monitoring required by [ipsetConn].
+type lastingConn struct {
+	*nftables.Conn
+}
+
+// type check
+var _ ipsetConn = (*lastingConn)(nil)
+
+// MonitorSetElements implements the [ipsetConn] interface for *lastingConn.
+//
+// It does not use [*nftables.Conn]'s own monitor support: for
+// NFT_MSG_NEWSETELEM/DELSETELEM messages, that support discards the table
+// and set name the event belongs to (see elementsFromMsg in the nftables
+// package), which this manager needs in order to tell which managed set
+// changed.  Instead, it opens a dedicated netlink socket and parses the raw
+// set-element netlink messages itself; see [dialNetlinkElemMonitor].
+func (c *lastingConn) MonitorSetElements(
+	ctx context.Context,
+) (events <-chan setElemEvent, closer io.Closer, err error) {
+	mon, err := dialNetlinkElemMonitor()
+	if err != nil {
+		return nil, nil, fmt.Errorf("subscribing to set element events: %w", err)
+	}
+
+	return mon.events(ctx), mon, nil
+}
+
+// newManagerWithDialer is like [newManager] but also accepts a custom dial
+// function for tests.
+func newManagerWithDialer(ctx context.Context, conf *Config, dial dialFunc) (set Manager, err error) {
+	defer func() { err = errors.Annotate(err, "ipset: %w") }()
+
+	c, err := dial()
 	if err != nil {
 		return nil, fmt.Errorf("creating nftables connection: %w", err)
 	}
 
+	flushInterval := conf.IpsetFlushInterval
+	if flushInterval <= 0 {
+		flushInterval = defaultFlushInterval
+	}
+
+	flushBatchSize := conf.IpsetFlushBatchSize
+	if flushBatchSize <= 0 {
+		flushBatchSize = defaultFlushBatchSize
+	}
+
 	m := &manager{
 		mu: &sync.Mutex{},
 
-		nameToIpset:    make(map[string]*nftables.Set),
-		domainToIpsets: make(map[string][]*nftables.Set),
+		nameToIpset:    make(map[string]ipsetRef),
+		domainToIpsets: make(map[string][]ipsetRef),
+		tableSetToRef:  make(map[string]ipsetRef),
 
 		logger: conf.Logger,
 		conn:   c,
 
-		addedIPs: container.NewMapSet[ipInIpsetEntry](),
+		autoCreateSets: conf.AutoCreateSets,
+		addedIPs:       container.NewMapSet[ipInIpsetEntry](),
+
+		flushInterval:  flushInterval,
+		flushBatchSize: flushBatchSize,
+		flushSignal:    make(chan struct{}, 1),
+		pending:        make(map[*nftables.Set][]nftables.SetElement),
 	}
 
 	err = m.parseIpsetConfig(ctx, conf.Lines)
@@ -56,39 +160,190 @@ func newManager(ctx context.Context, conf *Config) (set Manager, err error) {
 		return nil, fmt.Errorf("parsing ipset config: %w", err)
 	}
 
+	err = m.startMonitor(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("starting set element monitor: %w", err)
+	}
+
+	flushCtx, flushCancel := context.WithCancel(context.WithoutCancel(ctx))
+	m.flushCancel = flushCancel
+	go m.runFlushLoop(flushCtx)
+
 	m.logger.DebugContext(ctx, "nftables ipset manager initialized")
 
 	return m, nil
 }
 
+// startMonitor subscribes to live set-element change notifications and
+// starts the goroutine that reconciles them into m.addedIPs.  The
+// subscription is torn down by [manager.Close].
+func (m *manager) startMonitor(ctx context.Context) (err error) {
+	monCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+
+	events, closer, err := m.conn.MonitorSetElements(monCtx)
+	if err != nil {
+		cancel()
+
+		return err
+	}
+
+	m.monitorCancel = cancel
+	m.monitorCloser = closer
+
+	go m.watchSetElements(events)
+
+	return nil
+}
+
+// watchSetElements reconciles m.addedIPs with live set-element events until
+// events is closed.
+func (m *manager) watchSetElements(events <-chan setElemEvent) {
+	for ev := range events {
+		m.reconcileSetElement(ev)
+
+		if m.processed != nil {
+			m.processed <- struct{}{}
+		}
+	}
+}
+
+// reconcileSetElement updates m.addedIPs to reflect a set-element change
+// observed outside of this manager, e.g. another process flushing or
+// otherwise mutating a managed set.
+func (m *manager) reconcileSetElement(ev setElemEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ref, ok := m.tableSetToRef[ev.table+"/"+ev.set]
+	if !ok || ref.set.HasTimeout {
+		// Sets with element timeouts aren't cached in addedIPs, so there is
+		// nothing to reconcile.
+		return
+	}
+
+	// Keys of concatenated (ip, port) sets end with the port, padded to 4
+	// bytes; see newConcatSetElement.
+	ipKey := ev.key
+	var port uint16
+	if len(ref.ports) > 0 {
+		if len(ipKey) < 4 {
+			return
+		}
+
+		ipKey, port = ev.key[:len(ev.key)-4], binaryutil.BigEndian.Uint16(ev.key[len(ev.key)-4:])
+	}
+
+	var ipArr [net.IPv6len]byte
+	switch len(ipKey) {
+	case net.IPv4len, net.IPv6len:
+		copy(ipArr[:], net.IP(ipKey).To16())
+	default:
+		return
+	}
+
+	e := ipInIpsetEntry{ipsetName: ipsetNameOf(ref), ipArr: ipArr, port: port}
+	if ev.deleted {
+		m.addedIPs.Delete(e)
+	} else {
+		m.addedIPs.Add(e)
+	}
+}
+
 // manager is the Linux nftables ipset manager.
 type manager struct {
-	// nameToIpset maps ipset names in format "4#inet#table#set" to nftables.Set
-	nameToIpset    map[string]*nftables.Set
-	// domainToIpsets maps domain names to their corresponding nftables sets
-	domainToIpsets map[string][]*nftables.Set
+	// nameToIpset maps ipset names in format "4#family#table#set" to the
+	// resolved set.
+	nameToIpset map[string]ipsetRef
+	// domainToIpsets maps domain names to their corresponding nftables sets.
+	domainToIpsets map[string][]ipsetRef
+	// tableSetToRef maps "table/set" to the resolved ipsetRef, for looking up
+	// the ref a live monitor event belongs to.
+	tableSetToRef map[string]ipsetRef
 
 	logger *slog.Logger
-	conn   *nftables.Conn
-
-	// mu protects all properties below
+	conn   ipsetConn
+
+	// autoCreateSets, if true, makes the manager create sets that are
+	// referenced in the configuration but don't yet exist in nftables.
+	autoCreateSets bool
+
+	// monitorCancel stops the live set-element monitor started by
+	// [manager.startMonitor].
+	monitorCancel context.CancelFunc
+	// monitorCloser tears down the underlying netlink subscription.
+	monitorCloser io.Closer
+
+	// processed, if non-nil, receives a value after each live set-element
+	// event has been reconciled into addedIPs.  It is nil outside of tests,
+	// where it is used to synchronize on the monitor goroutine.
+	processed chan struct{}
+
+	// flushInterval is the maximum time pending set-element additions are
+	// buffered before [manager.runFlushLoop] writes them to nftables.
+	flushInterval time.Duration
+	// flushBatchSize is the number of elements pending for a single set
+	// that triggers an immediate flush, instead of waiting for
+	// flushInterval to elapse.
+	flushBatchSize int
+	// flushSignal requests an out-of-band flush once flushBatchSize is
+	// reached.  It is buffered so enqueueElements never blocks on it.
+	flushSignal chan struct{}
+	// flushCancel stops the background flush loop started by
+	// [manager.runFlushLoop].
+	flushCancel context.CancelFunc
+
+	// pendingMu protects pending.
+	pendingMu sync.Mutex
+	// pending buffers set-element additions awaiting the next flush.
+	pending map[*nftables.Set][]nftables.SetElement
+
+	// mu protects all properties below.
 	mu *sync.Mutex
 
-	// addedIPs tracks which IPs have been added to prevent duplicates
-	// Only persistent sets (without timeout) are tracked
+	// addedIPs tracks which IPs have been added to prevent duplicates.
+	// Only persistent sets (without timeout) are tracked.
 	addedIPs *container.MapSet[ipInIpsetEntry]
 }
 
-// ipInIpsetEntry represents an IP address entry in a specific ipset
+// ipInIpsetEntry represents an IP address entry in a specific ipset.
 type ipInIpsetEntry struct {
 	ipsetName string
 	// TODO(schzen): Use netip.Addr
 	ipArr [net.IPv6len]byte
+	// port is only set for entries in a concatenated (ip, port) set.
+	port uint16
+}
+
+// ipsetRef is a resolved nftables set together with the address family and,
+// for concatenated "ipv4_addr . inet_service"-style sets, the ports it was
+// configured with.
+type ipsetRef struct {
+	set    *nftables.Set
+	family string
+	ports  []uint16
+}
+
+// tableFamilies maps the family name used in the ipset configuration syntax
+// to the corresponding nftables table family.
+var tableFamilies = map[string]nftables.TableFamily{
+	"inet":   nftables.TableFamilyINet,
+	"ip":     nftables.TableFamilyIPv4,
+	"ip6":    nftables.TableFamilyIPv6,
+	"arp":    nftables.TableFamilyARP,
+	"bridge": nftables.TableFamilyBridge,
+	"netdev": nftables.TableFamilyNetdev,
 }
 
 // parseIpsetConfigLine parses one ipset configuration line.
-// Format: "domain1,domain2/4#inet#table#set1,4#inet#table#set2"
-// Only IPv4 sets are supported (prefix "4#")
+//
+// Format: "domain1,domain2/4#inet#table#set1,6#ip6#table#set2"
+//
+// The leading digit of each ipset name selects the address family: "4" for
+// IPv4 sets, "6" for IPv6 sets.  The second field selects the nftables table
+// family and must be one of "inet", "ip", "ip6", "arp", "bridge", or
+// "netdev".  The set name itself may carry a comma-separated ":port,port"
+// suffix (see [parseSetSpec]); those commas are not name separators, see
+// [splitIpsetNames].
 func parseIpsetConfigLine(confStr string) (hosts, ipsetNames []string, err error) {
 	confStr = strings.TrimSpace(confStr)
 	hostsAndNames := strings.Split(confStr, "/")
@@ -97,13 +352,12 @@ func parseIpsetConfigLine(confStr string) (hosts, ipsetNames []string, err error
 	}
 
 	hosts = strings.Split(hostsAndNames[0], ",")
-	ipsetNames = strings.Split(hostsAndNames[1], ",")
+	ipsetNames = splitIpsetNames(hostsAndNames[1])
 
 	if len(ipsetNames) == 0 {
 		return nil, nil, nil
 	}
 
-	// Валидация и очистка имен ipset
 	for i := range ipsetNames {
 		ipsetNames[i] = strings.TrimSpace(ipsetNames[i])
 		if len(ipsetNames[i]) == 0 {
@@ -111,7 +365,6 @@ func parseIpsetConfigLine(confStr string) (hosts, ipsetNames []string, err error
 		}
 	}
 
-	// Валидация и очистка доменов
 	for i := range hosts {
 		hosts[i] = strings.ToLower(strings.TrimSpace(hosts[i]))
 	}
@@ -128,60 +381,86 @@ func (m *manager) parseIpsetConfig(ctx context.Context, ipsetConf []string) (err
 			return fmt.Errorf("config line at idx %d(%s): %w", i, confStr, err)
 		}
 
-		var ipsets []*nftables.Set
+		var ipsets []ipsetRef
 		for _, n := range ipsetNames {
-			// Парсим формат "4#inet#table#set"
 			parts := strings.Split(n, "#")
 			if len(parts) != 4 {
 				return fmt.Errorf("parsing ipsets from config line at idx %d(l=%s,n=%s): wrong format, expected 4#inet#table#set", i, confStr, n)
 			}
 
-			// Проверяем, что это IPv4 set
-			if parts[0] != "4" {
-				return fmt.Errorf("parsing ipsets from config line at idx %d(l=%s,n=%s): only IPv4 sets supported (4#...)", i, confStr, n)
+			var addrType nftables.SetDatatype
+			switch parts[0] {
+			case "4":
+				addrType = nftables.TypeIPAddr
+			case "6":
+				addrType = nftables.TypeIP6Addr
+			default:
+				return fmt.Errorf("parsing ipsets from config line at idx %d(l=%s,n=%s): only 4# and 6# sets supported", i, confStr, n)
 			}
 
-			// Проверяем семейство таблицы
-			if parts[1] != "inet" {
-				return fmt.Errorf("parsing ipsets from config line at idx %d(l=%s,n=%s): only inet family supported", i, confStr, n)
+			family, ok := tableFamilies[parts[1]]
+			if !ok {
+				return fmt.Errorf(
+					"parsing ipsets from config line at idx %d(l=%s,n=%s): unsupported table family %q",
+					i, confStr, n, parts[1],
+				)
 			}
 
 			tableName := parts[2]
-			setName := parts[3]
 
-			// Проверяем кэш
-			set, ok := m.nameToIpset[n]
+			var setName string
+			var ports []uint16
+			var timeout time.Duration
+			setName, ports, timeout, err = parseSetSpec(parts[3])
+			if err != nil {
+				return fmt.Errorf("parsing ipsets from config line at idx %d(l=%s,n=%s): %w", i, confStr, n, err)
+			}
+
+			wantType := addrType
+			if len(ports) > 0 {
+				wantType = nftables.MustConcatSetType(addrType, nftables.TypeInetService)
+			}
+
+			ref, ok := m.nameToIpset[n]
 			if !ok {
-				// Получаем set из nftables
 				tbl := &nftables.Table{
-					Family: nftables.TableFamilyINet,
+					Family: family,
 					Name:   tableName,
 				}
 
+				var set *nftables.Set
 				set, err = m.conn.GetSetByName(tbl, setName)
 				if err != nil {
-					return fmt.Errorf("getting ipset from config line at idx %d(l=%s,n=%s): %w", i, confStr, n, err)
+					if !m.autoCreateSets {
+						return fmt.Errorf("getting ipset from config line at idx %d(l=%s,n=%s): %w", i, confStr, n, err)
+					}
+
+					set, err = m.createSet(ctx, tbl, setName, wantType, timeout)
+					if err != nil {
+						return fmt.Errorf("creating ipset from config line at idx %d(l=%s,n=%s): %w", i, confStr, n, err)
+					}
 				}
 
-				// Проверяем тип set - должен быть IPv4
-				if set.KeyType != nftables.TypeIPAddr {
-					return fmt.Errorf("got ipset from config line at idx %d(l=%s,n=%s): wrong type, expected ipv4_addr", i, confStr, n)
+				if set.KeyType != wantType {
+					return fmt.Errorf("got ipset from config line at idx %d(l=%s,n=%s): wrong type, expected %s", i, confStr, n, wantType.Name)
 				}
 
-				m.nameToIpset[n] = set
+				ref = ipsetRef{set: set, family: parts[0], ports: ports}
+				m.nameToIpset[n] = ref
+				m.tableSetToRef[tableName+"/"+setName] = ref
 				m.logger.DebugContext(ctx, "loaded nftables set",
 					"config_line", confStr,
 					"hosts", hosts,
 					"set_name", n,
 					"table", tableName,
 					"set", setName,
+					"ports", ports,
 				)
 			}
 
-			ipsets = append(ipsets, set)
+			ipsets = append(ipsets, ref)
 		}
 
-		// Связываем домены с sets
 		for _, host := range hosts {
 			m.domainToIpsets[host] = append(m.domainToIpsets[host], ipsets...)
 		}
@@ -190,16 +469,120 @@ func (m *manager) parseIpsetConfig(ctx context.Context, ipsetConf []string) (err
 	return nil
 }
 
+// splitIpsetNames splits the comma-separated list of ipset names following
+// the "/" in an ipset configuration line, without splitting on the commas
+// inside an individual name's ":443,8443"-style port-list suffix.
+//
+// A name is "4#family#table#set[:ports][;timeout]"; ports only ever follow
+// the third "#", so a comma is treated as part of the current name's port
+// list, rather than as a separator between names, from the point a ":" is
+// seen after the third "#" until the next ";" (or the end of the name).
+func splitIpsetNames(s string) (names []string) {
+	var hashes int
+	var inPorts bool
+	start := 0
+
+	for i, r := range s {
+		switch r {
+		case '#':
+			hashes++
+		case ':':
+			inPorts = hashes >= 3
+		case ';':
+			inPorts = false
+		case ',':
+			if !inPorts {
+				names = append(names, s[start:i])
+				start = i + 1
+				hashes, inPorts = 0, false
+			}
+		}
+	}
+
+	return append(names, s[start:])
+}
+
+// timeoutSuffix is the prefix of the optional ";timeout=<duration>" suffix
+// that may follow a set name in the ipset configuration syntax.
+const timeoutSuffix = "timeout="
+
+// parseSetSpec splits raw, the last "#"-separated field of an ipset name,
+// into the actual set name, an optional comma-separated list of ports given
+// as a ":443,8443"-style suffix, and an optional element timeout given as a
+// ";timeout=5m"-style suffix.  The port suffix, if present, comes before the
+// timeout suffix: "set:443,8443;timeout=5m".
+func parseSetSpec(raw string) (setName string, ports []uint16, timeout time.Duration, err error) {
+	namePart, tsuffix, hasTimeout := strings.Cut(raw, ";")
+	if hasTimeout {
+		val, ok := strings.CutPrefix(tsuffix, timeoutSuffix)
+		if !ok {
+			return "", nil, 0, fmt.Errorf("invalid set suffix %q: expected %q", tsuffix, timeoutSuffix+"<duration>")
+		}
+
+		timeout, err = time.ParseDuration(val)
+		if err != nil {
+			return "", nil, 0, fmt.Errorf("invalid timeout %q: %w", val, err)
+		}
+	}
+
+	setName, portsStr, hasPorts := strings.Cut(namePart, ":")
+	if !hasPorts {
+		return setName, nil, timeout, nil
+	}
+
+	for _, p := range strings.Split(portsStr, ",") {
+		var port uint64
+		port, err = strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return "", nil, 0, fmt.Errorf("invalid port %q: %w", p, err)
+		}
+
+		ports = append(ports, uint16(port))
+	}
+
+	return setName, ports, timeout, nil
+}
+
+// createSet creates a set with the given name, key type, and optional
+// element timeout in tbl.  It does not cache the set itself;
+// [manager.parseIpsetConfig] stores the returned set in m.nameToIpset.
+func (m *manager) createSet(
+	ctx context.Context,
+	tbl *nftables.Table,
+	setName string,
+	keyType nftables.SetDatatype,
+	timeout time.Duration,
+) (set *nftables.Set, err error) {
+	set = &nftables.Set{
+		Table:      tbl,
+		Name:       setName,
+		KeyType:    keyType,
+		HasTimeout: timeout > 0,
+		Timeout:    timeout,
+	}
+
+	err = m.conn.AddSet(set, nil)
+	if err != nil {
+		return nil, fmt.Errorf("adding set: %w", err)
+	}
+
+	err = m.conn.Flush()
+	if err != nil {
+		return nil, fmt.Errorf("flushing: %w", err)
+	}
+
+	m.logger.WarnContext(ctx, "created missing nftables set", "table", tbl.Name, "set", setName)
+
+	return set, nil
+}
+
 // lookupHost finds the nftables sets for the host, taking subdomain wildcards into account.
-func (m *manager) lookupHost(host string) (sets []*nftables.Set) {
-	// Поиск подходящих ipset начиная с наиболее специфичного домена
-	// Можно использовать trie, но простое решение достаточно эффективно:
-	// ~10 ns для TLD + SLD vs. ~140 ns для 10 поддоменов на AMD Ryzen 7 PRO 4750U
+func (m *manager) lookupHost(host string) (refs []ipsetRef) {
 	for i := 0; ; i++ {
 		host = host[i:]
-		sets = m.domainToIpsets[host]
-		if sets != nil {
-			return sets
+		refs = m.domainToIpsets[host]
+		if refs != nil {
+			return refs
 		}
 
 		i = strings.Index(host, ".")
@@ -208,107 +591,265 @@ func (m *manager) lookupHost(host string) (sets []*nftables.Set) {
 		}
 	}
 
-	// Проверяем корневой catch-all
 	return m.domainToIpsets[""]
 }
 
-// addIPs adds IPv4 addresses to the nftables set.
-func (m *manager) addIPs(host string, set *nftables.Set, ips []net.IP) (n int, err error) {
+// ipsetNameOf returns a unique key identifying ref's set.  It is used as the
+// key of [manager.addedIPs] entries and need not match the original
+// configuration syntax, only be unique per set.
+func ipsetNameOf(ref ipsetRef) (name string) {
+	return fmt.Sprintf("%s#%d#%s#%s", ref.family, ref.set.Table.Family, ref.set.Table.Name, ref.set.Name)
+}
+
+// addIPs enqueues IPv4 addresses for addition to the nftables set, giving
+// each element a Timeout of ttl if the set supports timeouts.  If ref.ports
+// is non-empty, one element is enqueued per (IP, port) pair into ref's
+// concatenated "ipv4_addr . inet_service" set.
+func (m *manager) addIPs(ref ipsetRef, ips []net.IP, ttl time.Duration) (n int) {
 	if len(ips) == 0 {
-		return 0, nil
+		return 0
 	}
 
 	var elements []nftables.SetElement
 	var newAddedEntries []ipInIpsetEntry
 
 	for _, ip := range ips {
-		// Создаем ключ для отслеживания добавленных IP
-		e := ipInIpsetEntry{
-			ipsetName: fmt.Sprintf("4#inet#%s#%s", set.Table.Name, set.Name),
+		ipv4 := ip.To4()
+		if ipv4 == nil {
+			continue
 		}
-		copy(e.ipArr[:], ip.To16())
 
-		// Пропускаем уже добавленные IP
-		if m.addedIPs.Has(e) {
+		elements, newAddedEntries = m.appendElements(
+			elements, newAddedEntries, ref, []byte(ipv4), ipv4.To16(), ttl,
+		)
+	}
+
+	return m.enqueueElements(ref.set, elements, newAddedEntries)
+}
+
+// addIP6s enqueues IPv6 addresses for addition to the nftables set, giving
+// each element a Timeout of ttl if the set supports timeouts.  If ref.ports
+// is non-empty, one element is enqueued per (IP, port) pair into ref's
+// concatenated "ipv6_addr . inet_service" set.
+func (m *manager) addIP6s(ref ipsetRef, ips []net.IP, ttl time.Duration) (n int) {
+	if len(ips) == 0 {
+		return 0
+	}
+
+	var elements []nftables.SetElement
+	var newAddedEntries []ipInIpsetEntry
+
+	for _, ip := range ips {
+		ipv6 := ip.To16()
+		if ipv6 == nil || ip.To4() != nil {
 			continue
 		}
 
-		// Создаем элемент для добавления в set
-		// Для IPv4 используем To4()
-		ipv4 := ip.To4()
-		if ipv4 == nil {
-			continue // Пропускаем не-IPv4 адреса
+		elements, newAddedEntries = m.appendElements(
+			elements, newAddedEntries, ref, ipv6, ipv6, ttl,
+		)
+	}
+
+	return m.enqueueElements(ref.set, elements, newAddedEntries)
+}
+
+// appendElements appends the elements and addedIPs entries for ip (encoded
+// as key for the plain set, ipArr for the addedIPs cache key) to elements
+// and newAddedEntries, expanding into one element per port when ref.ports
+// is non-empty.
+func (m *manager) appendElements(
+	elements []nftables.SetElement,
+	newAddedEntries []ipInIpsetEntry,
+	ref ipsetRef,
+	key []byte,
+	ipArr []byte,
+	ttl time.Duration,
+) ([]nftables.SetElement, []ipInIpsetEntry) {
+	if len(ref.ports) == 0 {
+		e := ipInIpsetEntry{ipsetName: ipsetNameOf(ref)}
+		copy(e.ipArr[:], ipArr)
+
+		if !ref.set.HasTimeout && m.addedIPs.Has(e) {
+			return elements, newAddedEntries
+		}
+
+		elements = append(elements, newSetElement(key, ref.set, ttl))
+		newAddedEntries = append(newAddedEntries, e)
+
+		return elements, newAddedEntries
+	}
+
+	for _, port := range ref.ports {
+		e := ipInIpsetEntry{ipsetName: ipsetNameOf(ref), port: port}
+		copy(e.ipArr[:], ipArr)
+
+		if !ref.set.HasTimeout && m.addedIPs.Has(e) {
+			continue
 		}
 
-		elements = append(elements, nftables.SetElement{
-			Key: []byte(ipv4),
-		})
+		elements = append(elements, newConcatSetElement(key, port, ref.set, ttl))
 		newAddedEntries = append(newAddedEntries, e)
 	}
 
+	return elements, newAddedEntries
+}
+
+// newSetElement builds a [nftables.SetElement] for key, setting its Timeout
+// to ttl when set supports element timeouts.
+func newSetElement(key []byte, set *nftables.Set, ttl time.Duration) (elem nftables.SetElement) {
+	elem = nftables.SetElement{Key: key}
+	if set.HasTimeout {
+		elem.Timeout = ttl
+	}
+
+	return elem
+}
+
+// newConcatSetElement builds a [nftables.SetElement] for a concatenated
+// "ip_addr . inet_service" set, encoding port in network byte order.
+func newConcatSetElement(ipKey []byte, port uint16, set *nftables.Set, ttl time.Duration) (elem nftables.SetElement) {
+	key := make([]byte, 0, len(ipKey)+4)
+	key = append(key, ipKey...)
+	// nftables pads concatenated fields to 4-byte boundaries.
+	portKey := make([]byte, 4)
+	copy(portKey, binaryutil.BigEndian.PutUint16(port))
+	key = append(key, portKey...)
+
+	return newSetElement(key, set, ttl)
+}
+
+// enqueueElements buffers elements to be written to set by the next
+// scheduled or forced flush (see [manager.runFlushLoop] and [manager.Flush]),
+// recording newAddedEntries in m.addedIPs immediately so that concurrent
+// calls coalesce duplicates before the flush happens.  Entries for sets with
+// element timeouts are never cached, since the kernel already expires them.
+func (m *manager) enqueueElements(
+	set *nftables.Set,
+	elements []nftables.SetElement,
+	newAddedEntries []ipInIpsetEntry,
+) (n int) {
 	n = len(elements)
 	if n == 0 {
-		return 0, nil
+		return 0
 	}
 
-	// Добавляем элементы в set
-	err = m.conn.SetAddElements(set, elements)
-	if err != nil {
-		return 0, fmt.Errorf("adding %q%v to set %q: %w", host, ips, set.Name, err)
+	if !set.HasTimeout {
+		for _, e := range newAddedEntries {
+			m.addedIPs.Add(e)
+		}
 	}
 
-	// Применяем изменения
-	err = m.conn.Flush()
-	if err != nil {
-		return 0, fmt.Errorf("flushing changes for %q%v to set %q: %w", host, ips, set.Name, err)
+	m.pendingMu.Lock()
+	m.pending[set] = append(m.pending[set], elements...)
+	pendingForSet := len(m.pending[set])
+	m.pendingMu.Unlock()
+
+	if pendingForSet >= m.flushBatchSize {
+		select {
+		case m.flushSignal <- struct{}{}:
+		default:
+			// A flush is already pending.
+		}
 	}
 
-	// Добавляем в кэш только после успешного добавления
-	// Только для persistent sets (без timeout)
-	for _, e := range newAddedEntries {
-		set := m.nameToIpset[e.ipsetName]
-		if !set.HasTimeout {
-			m.addedIPs.Add(e)
+	return n
+}
+
+// runFlushLoop periodically flushes pending set-element additions to
+// nftables until ctx is canceled, either every flushInterval or as soon as
+// flushBatchSize is reached for some set.
+func (m *manager) runFlushLoop(ctx context.Context) {
+	ticker := time.NewTicker(m.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.flushSignal:
+		case <-ctx.Done():
+			return
+		}
+
+		err := m.flushPending(ctx)
+		if err != nil {
+			m.logger.ErrorContext(ctx, "background ipset flush failed", "err", err)
 		}
 	}
+}
 
-	return n, nil
+// flushPending writes all currently buffered set-element additions to
+// nftables in one batch per set.  It returns the first error encountered,
+// having still attempted every pending set.
+func (m *manager) flushPending(ctx context.Context) (err error) {
+	m.pendingMu.Lock()
+	pending := m.pending
+	m.pending = make(map[*nftables.Set][]nftables.SetElement, len(pending))
+	m.pendingMu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	for set, elements := range pending {
+		addErr := m.conn.SetAddElements(set, elements)
+		if addErr != nil {
+			addErr = fmt.Errorf("adding elements to set %q: %w", set.Name, addErr)
+			m.logger.ErrorContext(ctx, "flushing pending ipset elements", "set", set.Name, "err", addErr)
+
+			if err == nil {
+				err = addErr
+			}
+		}
+	}
+
+	flushErr := m.conn.Flush()
+	if flushErr != nil {
+		flushErr = fmt.Errorf("flushing nftables changes: %w", flushErr)
+		if err == nil {
+			err = flushErr
+		}
+	}
+
+	return err
 }
 
-// addToSets adds IP addresses to the corresponding nftables sets.
+// Flush implements the [Manager] interface for *manager.
+func (m *manager) Flush(ctx context.Context) (err error) {
+	return m.flushPending(ctx)
+}
+
+// addToSets enqueues IP addresses for addition to the corresponding nftables
+// sets.  The actual write happens asynchronously; see [manager.runFlushLoop]
+// and [manager.Flush].
 func (m *manager) addToSets(
 	ctx context.Context,
 	host string,
 	ip4s []net.IP,
 	ip6s []net.IP,
-	sets []*nftables.Set,
+	ttl time.Duration,
+	refs []ipsetRef,
 ) (n int, err error) {
-	for _, set := range sets {
+	for _, ref := range refs {
 		var nn int
-
-		// Поддерживаем только IPv4 sets
-		switch set.KeyType {
-		case nftables.TypeIPAddr:
-			nn, err = m.addIPs(host, set, ip4s)
-			if err != nil {
-				return n, err
-			}
-		case nftables.TypeIP6Addr:
-			// IPv6 не поддерживается в этой версии
-			m.logger.DebugContext(ctx, "skipping IPv6 set (not supported)",
-				"set_name", set.Name,
-				"set_type", set.KeyType,
-			)
-			continue
+		var ips []net.IP
+
+		switch ref.family {
+		case "4":
+			ips = ip4s
+			nn = m.addIPs(ref, ip4s, ttl)
+		case "6":
+			ips = ip6s
+			nn = m.addIP6s(ref, ip6s, ttl)
 		default:
-			return n, fmt.Errorf("set %q has unexpected type %q", set.Name, set.KeyType)
+			return n, fmt.Errorf("set %q has unexpected family %q", ref.set.Name, ref.family)
 		}
 
-		m.logger.DebugContext(ctx, "added ips to nftables set",
+		m.logger.DebugContext(ctx, "enqueued ips for nftables set",
 			"ips_added", nn,
-			"ip4s", ip4s,
-			"set_name", set.Name,
-			"set_type", set.KeyType,
+			"ips", ips,
+			"set_name", ref.set.Name,
+			"set_type", ref.set.KeyType,
+			"ports", ref.ports,
 		)
 
 		n += nn
@@ -318,7 +859,12 @@ func (m *manager) addToSets(
 }
 
 // Add implements the [Manager] interface for *manager.
-func (m *manager) Add(ctx context.Context, host string, ip4s, ip6s []net.IP) (n int, err error) {
+func (m *manager) Add(
+	ctx context.Context,
+	host string,
+	ip4s, ip6s []net.IP,
+	ttl time.Duration,
+) (n int, err error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -332,19 +878,39 @@ func (m *manager) Add(ctx context.Context, host string, ip4s, ip6s []net.IP) (n
 		"sets_count", len(sets),
 	)
 
-	return m.addToSets(ctx, host, ip4s, ip6s, sets)
+	return m.addToSets(ctx, host, ip4s, ip6s, ttl, sets)
 }
 
-// Close implements the [Manager] interface for *manager.
+// Close implements the [Manager] interface for *manager.  It flushes any
+// pending set-element additions before closing the connection.
 func (m *manager) Close() (err error) {
+	if m.monitorCancel != nil {
+		m.monitorCancel()
+	}
+
+	if m.monitorCloser != nil {
+		// Closing the netlink socket makes the monitor goroutine's pending
+		// receive fail, which ends it; the error is ignored.
+		_ = m.monitorCloser.Close()
+	}
+
+	if m.flushCancel != nil {
+		m.flushCancel()
+	}
+
+	flushErr := m.flushPending(context.Background())
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// Закрываем соединение с nftables
 	err = m.conn.CloseLasting()
 	if err != nil {
 		return errors.Annotate(err, "closing nftables connection: %w")
 	}
 
+	if flushErr != nil {
+		return errors.Annotate(flushErr, "flushing pending elements before close: %w")
+	}
+
 	return nil
 }
@@ -3,166 +3,471 @@
 package ipset
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net"
-	"strings"
 	"testing"
 	"time"
 
-	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/testutil"
-	"github.com/digineo/go-ipset/v2"
-	"github.com/mdlayher/netlink"
+	"github.com/google/nftables"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	"github.com/ti-mo/netfilter"
 )
 
 // testTimeout is a common timeout for tests and contexts.
 const testTimeout = 1 * time.Second
 
-// fakeConn is a fake ipsetConn for tests.
+// fakeConn is a fake [ipsetConn] for tests.
 type fakeConn struct {
-	ipv4Header  *ipset.HeaderPolicy
-	ipv4Entries *[]*ipset.Entry
-	ipv6Header  *ipset.HeaderPolicy
-	ipv6Entries *[]*ipset.Entry
-	sets        []props
+	sets     map[string]*nftables.Set
+	elements map[string][]nftables.SetElement
+
+	// monitorEvents, if non-nil, is the source of events returned by
+	// MonitorSetElements.  Tests send synthetic events on it to exercise
+	// live set-element reconciliation.
+	monitorEvents chan setElemEvent
+}
+
+// newFakeConn returns a *fakeConn with sets registered under
+// "table/name".
+func newFakeConn(sets ...*nftables.Set) (c *fakeConn) {
+	c = &fakeConn{
+		sets:     map[string]*nftables.Set{},
+		elements: map[string][]nftables.SetElement{},
+	}
+
+	for _, s := range sets {
+		c.sets[s.Table.Name+"/"+s.Name] = s
+	}
+
+	return c
 }
 
 // type check
 var _ ipsetConn = (*fakeConn)(nil)
 
-// Add implements the [ipsetConn] interface for *fakeConn.
-func (c *fakeConn) Add(name string, entries ...*ipset.Entry) (err error) {
-	if strings.Contains(name, "ipv4") {
-		*c.ipv4Entries = append(*c.ipv4Entries, entries...)
+// GetSetByName implements the [ipsetConn] interface for *fakeConn.
+func (c *fakeConn) GetSetByName(table *nftables.Table, name string) (set *nftables.Set, err error) {
+	set, ok := c.sets[table.Name+"/"+name]
+	if !ok {
+		return nil, fmt.Errorf("test: set %q not found", name)
+	}
 
-		return nil
-	} else if strings.Contains(name, "ipv6") {
-		*c.ipv6Entries = append(*c.ipv6Entries, entries...)
+	return set, nil
+}
 
-		return nil
-	}
+// AddSet implements the [ipsetConn] interface for *fakeConn.
+func (c *fakeConn) AddSet(set *nftables.Set, _ []nftables.SetElement) (err error) {
+	c.sets[set.Table.Name+"/"+set.Name] = set
 
-	return errors.Error("test: ipset not found")
+	return nil
+}
+
+// SetAddElements implements the [ipsetConn] interface for *fakeConn.
+func (c *fakeConn) SetAddElements(set *nftables.Set, vals []nftables.SetElement) (err error) {
+	key := set.Table.Name + "/" + set.Name
+	c.elements[key] = append(c.elements[key], vals...)
+
+	return nil
 }
 
-// Close implements the [ipsetConn] interface for *fakeConn.
-func (c *fakeConn) Close() (err error) {
+// Flush implements the [ipsetConn] interface for *fakeConn.
+func (c *fakeConn) Flush() (err error) {
 	return nil
 }
 
-// Header implements the [ipsetConn] interface for *fakeConn.
-func (c *fakeConn) Header(_ string) (_ *ipset.HeaderPolicy, _ error) {
-	return nil, nil
+// CloseLasting implements the [ipsetConn] interface for *fakeConn.
+func (c *fakeConn) CloseLasting() (err error) {
+	return nil
 }
 
-// listAll implements the [ipsetConn] interface for *fakeConn.
-func (c *fakeConn) listAll() (sets []props, err error) {
-	return c.sets, nil
+// MonitorSetElements implements the [ipsetConn] interface for *fakeConn.  It
+// relays events sent on c.monitorEvents, if any, until ctx is canceled.
+func (c *fakeConn) MonitorSetElements(
+	ctx context.Context,
+) (events <-chan setElemEvent, closer io.Closer, err error) {
+	out := make(chan setElemEvent)
+	go func() {
+		defer close(out)
+
+		for {
+			select {
+			case ev, ok := <-c.monitorEvents:
+				if !ok {
+					return
+				}
+
+				select {
+				case out <- ev:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, io.NopCloser(nil), nil
 }
 
 func TestManager_Add(t *testing.T) {
+	tbl := &nftables.Table{Family: nftables.TableFamilyINet, Name: "fw4"}
+	set4 := &nftables.Set{Table: tbl, Name: "ipv4set", KeyType: nftables.TypeIPAddr}
+	set6 := &nftables.Set{Table: tbl, Name: "ipv6set", KeyType: nftables.TypeIP6Addr}
+
+	conn := newFakeConn(set4, set6)
+
 	ipsetList := []string{
-		"example.com,example.net/ipv4set",
-		"example.org,example.biz/ipv6set",
-	}
-
-	var ipv4Entries []*ipset.Entry
-	var ipv6Entries []*ipset.Entry
-
-	fakeDial := func(
-		pf netfilter.ProtoFamily,
-		conf *netlink.Config,
-	) (conn ipsetConn, err error) {
-		return &fakeConn{
-			ipv4Header: &ipset.HeaderPolicy{
-				Family: ipset.NewUInt8Box(uint8(netfilter.ProtoIPv4)),
-			},
-			ipv4Entries: &ipv4Entries,
-			ipv6Header: &ipset.HeaderPolicy{
-				Family: ipset.NewUInt8Box(uint8(netfilter.ProtoIPv6)),
-			},
-			ipv6Entries: &ipv6Entries,
-			sets: []props{{
-				name:   "ipv4set",
-				family: netfilter.ProtoIPv4,
-			}, {
-				name:   "ipv6set",
-				family: netfilter.ProtoIPv6,
-			}},
-		}, nil
+		"example.com,example.net/4#inet#fw4#ipv4set",
+		"example.org,example.biz/6#inet#fw4#ipv6set",
 	}
 
 	conf := &Config{
 		Logger: slogutil.NewDiscardLogger(),
 		Lines:  ipsetList,
 	}
-	m, err := newManagerWithDialer(testutil.ContextWithTimeout(t, testTimeout), conf, fakeDial)
+
+	m, err := newManagerWithDialer(
+		testutil.ContextWithTimeout(t, testTimeout),
+		conf,
+		func() (ipsetConn, error) { return conn, nil },
+	)
+	require.NoError(t, err)
+
+	ip4 := net.IPv4(1, 2, 3, 4)
+	ip6 := net.ParseIP("1234::5678")
+
+	n, err := m.Add(testutil.ContextWithTimeout(t, testTimeout), "example.net", []net.IP{ip4}, nil, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	n, err = m.Add(testutil.ContextWithTimeout(t, testTimeout), "example.biz", nil, []net.IP{ip6}, 0)
 	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	require.NoError(t, m.Flush(testutil.ContextWithTimeout(t, testTimeout)))
+
+	require.Len(t, conn.elements["fw4/ipv4set"], 1)
+	assert.Equal(t, []byte(ip4.To4()), conn.elements["fw4/ipv4set"][0].Key)
 
-	ip4 := net.IP{1, 2, 3, 4}
-	ip6 := net.IP{
-		0x12, 0x34, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x56, 0x78,
+	require.Len(t, conn.elements["fw4/ipv6set"], 1)
+	assert.Equal(t, []byte(ip6.To16()), conn.elements["fw4/ipv6set"][0].Key)
+
+	err = m.Close()
+	assert.NoError(t, err)
+}
+
+func TestManager_Add_ttl(t *testing.T) {
+	tbl := &nftables.Table{Family: nftables.TableFamilyINet, Name: "fw4"}
+	set := &nftables.Set{
+		Table:      tbl,
+		Name:       "timeoutset",
+		KeyType:    nftables.TypeIPAddr,
+		HasTimeout: true,
+	}
+
+	conn := newFakeConn(set)
+
+	conf := &Config{
+		Logger: slogutil.NewDiscardLogger(),
+		Lines:  []string{"example.com/4#inet#fw4#timeoutset"},
 	}
 
-	n, err := m.Add(testutil.ContextWithTimeout(t, testTimeout), "example.net", []net.IP{ip4}, nil)
+	m, err := newManagerWithDialer(
+		testutil.ContextWithTimeout(t, testTimeout),
+		conf,
+		func() (ipsetConn, error) { return conn, nil },
+	)
 	require.NoError(t, err)
 
+	ip4 := net.IPv4(1, 2, 3, 4)
+	ttl := 30 * time.Second
+
+	n, err := m.Add(testutil.ContextWithTimeout(t, testTimeout), "example.com", []net.IP{ip4}, nil, ttl)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	require.NoError(t, m.Flush(testutil.ContextWithTimeout(t, testTimeout)))
+
+	require.Len(t, conn.elements["fw4/timeoutset"], 1)
+	assert.Equal(t, ttl, conn.elements["fw4/timeoutset"][0].Timeout)
+
+	// Re-adding the same IP must not be suppressed by addedIPs, since sets
+	// with a timeout aren't cached.
+	n, err = m.Add(testutil.ContextWithTimeout(t, testTimeout), "example.com", []net.IP{ip4}, nil, ttl)
+	require.NoError(t, err)
 	assert.Equal(t, 1, n)
 
-	require.Len(t, ipv4Entries, 1)
+	require.NoError(t, m.Flush(testutil.ContextWithTimeout(t, testTimeout)))
+	assert.Len(t, conn.elements["fw4/timeoutset"], 2)
+}
+
+func TestManager_Add_ports(t *testing.T) {
+	tbl := &nftables.Table{Family: nftables.TableFamilyINet, Name: "fw4"}
+	set := &nftables.Set{
+		Table:   tbl,
+		Name:    "web_targets",
+		KeyType: nftables.MustConcatSetType(nftables.TypeIPAddr, nftables.TypeInetService),
+	}
+
+	conn := newFakeConn(set)
+
+	conf := &Config{
+		Logger: slogutil.NewDiscardLogger(),
+		Lines:  []string{"example.com/4#inet#fw4#web_targets:443,8443"},
+	}
+
+	m, err := newManagerWithDialer(
+		testutil.ContextWithTimeout(t, testTimeout),
+		conf,
+		func() (ipsetConn, error) { return conn, nil },
+	)
+	require.NoError(t, err)
+
+	ip4 := net.IPv4(1, 2, 3, 4)
+
+	n, err := m.Add(testutil.ContextWithTimeout(t, testTimeout), "example.com", []net.IP{ip4}, nil, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	require.NoError(t, m.Flush(testutil.ContextWithTimeout(t, testTimeout)))
+
+	require.Len(t, conn.elements["fw4/web_targets"], 2)
+
+	wantKey443 := append(append([]byte{}, ip4.To4()...), 0x01, 0xBB, 0x00, 0x00)
+	assert.Equal(t, wantKey443, conn.elements["fw4/web_targets"][0].Key)
+}
+
+func TestManager_liveReconcile(t *testing.T) {
+	tbl := &nftables.Table{Family: nftables.TableFamilyINet, Name: "fw4"}
+	set := &nftables.Set{Table: tbl, Name: "ipv4set", KeyType: nftables.TypeIPAddr}
+
+	conn := newFakeConn(set)
+	conn.monitorEvents = make(chan setElemEvent)
+
+	conf := &Config{
+		Logger: slogutil.NewDiscardLogger(),
+		Lines:  []string{"example.com/4#inet#fw4#ipv4set"},
+	}
+
+	mgr, err := newManagerWithDialer(
+		testutil.ContextWithTimeout(t, testTimeout),
+		conf,
+		func() (ipsetConn, error) { return conn, nil },
+	)
+	require.NoError(t, err)
+
+	m := mgr.(*manager)
+	m.processed = make(chan struct{}, 1)
+
+	ip4 := net.IPv4(1, 2, 3, 4)
+	e := ipInIpsetEntry{ipsetName: ipsetNameOf(ipsetRef{set: set, family: "4"})}
+	copy(e.ipArr[:], ip4.To4().To16())
+
+	require.False(t, m.addedIPs.Has(e))
+
+	// Simulate an external tool (e.g. "nft add element") adding the IP to
+	// the kernel set without going through the manager.
+	conn.monitorEvents <- setElemEvent{table: "fw4", set: "ipv4set", key: []byte(ip4.To4())}
+	<-m.processed
+
+	m.mu.Lock()
+	assert.True(t, m.addedIPs.Has(e))
+	m.mu.Unlock()
+
+	// An external "nft delete element" must be reconciled too.
+	conn.monitorEvents <- setElemEvent{table: "fw4", set: "ipv4set", key: []byte(ip4.To4()), deleted: true}
+	<-m.processed
 
-	gotIP4 := ipv4Entries[0].IP.Value
-	assert.Equal(t, ip4, gotIP4)
+	m.mu.Lock()
+	assert.False(t, m.addedIPs.Has(e))
+	m.mu.Unlock()
 
-	n, err = m.Add(testutil.ContextWithTimeout(t, testTimeout), "example.biz", nil, []net.IP{ip6})
+	assert.NoError(t, m.Close())
+}
+
+func TestManager_liveReconcile_batchedFlush(t *testing.T) {
+	tbl := &nftables.Table{Family: nftables.TableFamilyINet, Name: "fw4"}
+	set := &nftables.Set{Table: tbl, Name: "ipv4set", KeyType: nftables.TypeIPAddr}
+
+	conn := newFakeConn(set)
+	conn.monitorEvents = make(chan setElemEvent)
+
+	conf := &Config{
+		Logger:              slogutil.NewDiscardLogger(),
+		Lines:               []string{"example.com/4#inet#fw4#ipv4set"},
+		IpsetFlushBatchSize: 2,
+	}
+
+	mgr, err := newManagerWithDialer(
+		testutil.ContextWithTimeout(t, testTimeout),
+		conf,
+		func() (ipsetConn, error) { return conn, nil },
+	)
 	require.NoError(t, err)
 
+	m := mgr.(*manager)
+	m.processed = make(chan struct{}, 1)
+
+	// Enqueue a pending Add that hasn't been flushed yet, then reconcile a
+	// live monitor event for a different address; the two code paths share
+	// m.mu/m.addedIPs and must not deadlock or clobber each other's state.
+	ip4 := net.IPv4(1, 2, 3, 4)
+	n, err := m.Add(testutil.ContextWithTimeout(t, testTimeout), "example.com", []net.IP{ip4}, nil, 0)
+	require.NoError(t, err)
 	assert.Equal(t, 1, n)
 
-	require.Len(t, ipv6Entries, 1)
+	liveIP := net.IPv4(5, 6, 7, 8)
+	e := ipInIpsetEntry{ipsetName: ipsetNameOf(ipsetRef{set: set, family: "4"})}
+	copy(e.ipArr[:], liveIP.To4().To16())
 
-	gotIP6 := ipv6Entries[0].IP.Value
-	assert.Equal(t, ip6, gotIP6)
+	conn.monitorEvents <- setElemEvent{table: "fw4", set: "ipv4set", key: []byte(liveIP.To4())}
+	<-m.processed
 
-	err = m.Close()
-	assert.NoError(t, err)
+	m.mu.Lock()
+	assert.True(t, m.addedIPs.Has(e))
+	m.mu.Unlock()
+
+	require.NoError(t, m.Flush(testutil.ContextWithTimeout(t, testTimeout)))
+	require.Len(t, conn.elements["fw4/ipv4set"], 1)
+	assert.Equal(t, []byte(ip4.To4()), conn.elements["fw4/ipv4set"][0].Key)
+
+	assert.NoError(t, m.Close())
 }
 
-func BenchmarkManager_LookupHost(b *testing.B) {
-	propsLong := []props{{
-		name:   "example.com",
-		family: netfilter.ProtoIPv4,
-	}}
+func TestManager_parseIpsetConfig_portsOnPlainSet(t *testing.T) {
+	set := &nftables.Set{
+		Table:   &nftables.Table{Family: nftables.TableFamilyINet, Name: "fw4"},
+		Name:    "plain",
+		KeyType: nftables.TypeIPAddr,
+	}
+
+	conf := &Config{
+		Logger: slogutil.NewDiscardLogger(),
+		Lines:  []string{"example.com/4#inet#fw4#plain:443"},
+	}
+
+	_, err := newManagerWithDialer(
+		testutil.ContextWithTimeout(t, testTimeout),
+		conf,
+		func() (ipsetConn, error) { return newFakeConn(set), nil },
+	)
+	assert.Error(t, err)
+}
+
+func TestManager_parseIpsetConfig_tableFamilies(t *testing.T) {
+	sets := []*nftables.Set{
+		{Table: &nftables.Table{Family: nftables.TableFamilyINet, Name: "inet_tbl"}, Name: "s", KeyType: nftables.TypeIPAddr},
+		{Table: &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "ip_tbl"}, Name: "s", KeyType: nftables.TypeIPAddr},
+		{Table: &nftables.Table{Family: nftables.TableFamilyIPv6, Name: "ip6_tbl"}, Name: "s", KeyType: nftables.TypeIP6Addr},
+		{Table: &nftables.Table{Family: nftables.TableFamilyARP, Name: "arp_tbl"}, Name: "s", KeyType: nftables.TypeIPAddr},
+		{Table: &nftables.Table{Family: nftables.TableFamilyBridge, Name: "bridge_tbl"}, Name: "s", KeyType: nftables.TypeIPAddr},
+		{Table: &nftables.Table{Family: nftables.TableFamilyNetdev, Name: "netdev_tbl"}, Name: "s", KeyType: nftables.TypeIPAddr},
+	}
+
+	conn := newFakeConn(sets...)
+
+	conf := &Config{
+		Logger: slogutil.NewDiscardLogger(),
+		Lines: []string{
+			"inet.example/4#inet#inet_tbl#s",
+			"ip.example/4#ip#ip_tbl#s",
+			"ip6.example/6#ip6#ip6_tbl#s",
+			"arp.example/4#arp#arp_tbl#s",
+			"bridge.example/4#bridge#bridge_tbl#s",
+			"netdev.example/4#netdev#netdev_tbl#s",
+		},
+	}
+
+	_, err := newManagerWithDialer(
+		testutil.ContextWithTimeout(t, testTimeout),
+		conf,
+		func() (ipsetConn, error) { return conn, nil },
+	)
+	require.NoError(t, err)
+}
+
+func TestManager_parseIpsetConfig_badFamily(t *testing.T) {
+	conf := &Config{
+		Logger: slogutil.NewDiscardLogger(),
+		Lines:  []string{"example.com/4#inet6#fw4#s"},
+	}
+
+	_, err := newManagerWithDialer(
+		testutil.ContextWithTimeout(t, testTimeout),
+		conf,
+		func() (ipsetConn, error) { return newFakeConn(), nil },
+	)
+	assert.Error(t, err)
+}
+
+func TestManager_parseIpsetConfig_autoCreate(t *testing.T) {
+	conn := newFakeConn()
 
-	propsShort := []props{{
-		name:   "example.net",
-		family: netfilter.ProtoIPv4,
-	}}
+	conf := &Config{
+		Logger:         slogutil.NewDiscardLogger(),
+		Lines:          []string{"example.com/4#inet#fw4#web_targets;timeout=5m"},
+		AutoCreateSets: true,
+	}
+
+	_, err := newManagerWithDialer(
+		testutil.ContextWithTimeout(t, testTimeout),
+		conf,
+		func() (ipsetConn, error) { return conn, nil },
+	)
+	require.NoError(t, err)
+
+	got, ok := conn.sets["fw4/web_targets"]
+	require.True(t, ok)
+
+	assert.Equal(t, nftables.TypeIPAddr, got.KeyType)
+	assert.True(t, got.HasTimeout)
+	assert.Equal(t, 5*time.Minute, got.Timeout)
+}
+
+func TestManager_parseIpsetConfig_noAutoCreate(t *testing.T) {
+	conn := newFakeConn()
+
+	conf := &Config{
+		Logger: slogutil.NewDiscardLogger(),
+		Lines:  []string{"example.com/4#inet#fw4#web_targets"},
+	}
+
+	_, err := newManagerWithDialer(
+		testutil.ContextWithTimeout(t, testTimeout),
+		conf,
+		func() (ipsetConn, error) { return conn, nil },
+	)
+	assert.Error(t, err)
+}
+
+func BenchmarkManager_LookupHost(b *testing.B) {
+	tbl := &nftables.Table{Family: nftables.TableFamilyINet, Name: "fw4"}
+	setLong := []ipsetRef{{set: &nftables.Set{Table: tbl, Name: "example.com", KeyType: nftables.TypeIPAddr}, family: "4"}}
+	setShort := []ipsetRef{{set: &nftables.Set{Table: tbl, Name: "example.net", KeyType: nftables.TypeIPAddr}, family: "4"}}
 
 	m := &manager{
-		domainToIpsets: map[string][]props{
-			"":            propsLong,
-			"example.net": propsShort,
+		domainToIpsets: map[string][]ipsetRef{
+			"":            setLong,
+			"example.net": setShort,
 		},
 	}
 
-	var ipsetPropsSink []props
+	var ipsetSink []ipsetRef
 
 	b.Run("long", func(b *testing.B) {
 		const name = "a.very.long.domain.name.inside.the.domain.example.com"
 
 		b.ReportAllocs()
 		for b.Loop() {
-			ipsetPropsSink = m.lookupHost(name)
+			ipsetSink = m.lookupHost(name)
 		}
 
-		require.Equal(b, propsLong, ipsetPropsSink)
+		require.Equal(b, setLong, ipsetSink)
 	})
 
 	b.Run("short", func(b *testing.B) {
@@ -170,10 +475,10 @@ func BenchmarkManager_LookupHost(b *testing.B) {
 
 		b.ReportAllocs()
 		for b.Loop() {
-			ipsetPropsSink = m.lookupHost(name)
+			ipsetSink = m.lookupHost(name)
 		}
 
-		require.Equal(b, propsShort, ipsetPropsSink)
+		require.Equal(b, setShort, ipsetSink)
 	})
 
 	// Most recent results:
@@ -185,3 +490,61 @@ func BenchmarkManager_LookupHost(b *testing.B) {
 	//	BenchmarkManager_LookupHost/long-8         	 6562424	       174.8 ns/op	       0 B/op	       0 allocs/op
 	//	BenchmarkManager_LookupHost/short-8        	100000000	        10.72 ns/op	       0 B/op	       0 allocs/op
 }
+
+// BenchmarkManager_Add compares the unbatched path (a flush is signaled on
+// every call) against the default batched path, where Add only enqueues and
+// a background goroutine amortizes the netlink round trip across many
+// calls.
+func BenchmarkManager_Add(b *testing.B) {
+	tbl := &nftables.Table{Family: nftables.TableFamilyINet, Name: "fw4"}
+
+	newMgr := func(batchSize int) Manager {
+		conn := newFakeConn(&nftables.Set{Table: tbl, Name: "bench_set", KeyType: nftables.TypeIPAddr})
+
+		conf := &Config{
+			Logger:              slogutil.NewDiscardLogger(),
+			Lines:               []string{"example.com/4#inet#fw4#bench_set"},
+			IpsetFlushBatchSize: batchSize,
+		}
+
+		m, err := newManagerWithDialer(
+			context.Background(),
+			conf,
+			func() (ipsetConn, error) { return conn, nil },
+		)
+		require.NoError(b, err)
+
+		return m
+	}
+
+	runAdd := func(b *testing.B, m Manager) {
+		ctx := context.Background()
+
+		b.ReportAllocs()
+
+		var i uint32
+		for b.Loop() {
+			i++
+			ip := net.IPv4(byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
+
+			_, err := m.Add(ctx, "example.com", []net.IP{ip}, nil, 0)
+			require.NoError(b, err)
+		}
+
+		require.NoError(b, m.Flush(ctx))
+	}
+
+	b.Run("unbatched", func(b *testing.B) {
+		m := newMgr(1)
+		defer func() { require.NoError(b, m.Close()) }()
+
+		runAdd(b, m)
+	})
+
+	b.Run("batched", func(b *testing.B) {
+		m := newMgr(defaultFlushBatchSize)
+		defer func() { require.NoError(b, m.Close()) }()
+
+		runAdd(b, m)
+	})
+}
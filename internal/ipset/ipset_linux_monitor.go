@@ -0,0 +1,198 @@
+//go:build linux
+
+package ipset
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// netlinkElemMonitor is a dedicated netlink socket subscribed to nftables
+// set-element change notifications, decoded without going through
+// [*nftables.Conn]; see [*lastingConn.MonitorSetElements].
+type netlinkElemMonitor struct {
+	conn *netlink.Conn
+}
+
+// dialNetlinkElemMonitor opens netlinkElemMonitor's socket and joins the
+// nftables multicast group.  The socket is independent of any
+// [*nftables.Conn], since that type doesn't expose its underlying netlink
+// connection for reuse.
+func dialNetlinkElemMonitor() (mon *netlinkElemMonitor, err error) {
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return nil, fmt.Errorf("dialing netfilter netlink socket: %w", err)
+	}
+
+	err = conn.JoinGroup(unix.NFNLGRP_NFTABLES)
+	if err != nil {
+		_ = conn.Close()
+
+		return nil, fmt.Errorf("joining nftables multicast group: %w", err)
+	}
+
+	return &netlinkElemMonitor{conn: conn}, nil
+}
+
+// Close implements the io.Closer interface for *netlinkElemMonitor.
+func (m *netlinkElemMonitor) Close() (err error) {
+	return m.conn.Close()
+}
+
+// events starts reading set-element events from the socket in a background
+// goroutine and returns the channel they're delivered on.  The channel is
+// closed once the socket is closed, e.g. via [*netlinkElemMonitor.Close].
+func (m *netlinkElemMonitor) events(ctx context.Context) (out <-chan setElemEvent) {
+	ch := make(chan setElemEvent)
+
+	go func() {
+		defer close(ch)
+
+		for {
+			msgs, err := m.conn.Receive()
+			if err != nil {
+				// The socket has been closed, either by us or because the
+				// process is shutting down.
+				return
+			}
+
+			for _, msg := range msgs {
+				for _, ev := range setElemEventsFromMessage(msg) {
+					select {
+					case ch <- ev:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return ch
+}
+
+// nfSubsysShift is the bit offset of the nfnetlink subsystem ID within a
+// netlink message header's Type field; the message type proper occupies the
+// low byte.
+const nfSubsysShift = 8
+
+// setElemEventsFromMessage extracts the set-element events from a single raw
+// nftables netlink message, or nil if msg is not a set-element add/delete
+// notification.
+func setElemEventsFromMessage(msg netlink.Message) (events []setElemEvent) {
+	if uint8(msg.Header.Type>>nfSubsysShift) != unix.NFNL_SUBSYS_NFTABLES {
+		return nil
+	}
+
+	var deleted bool
+	switch uint8(msg.Header.Type) {
+	case unix.NFT_MSG_NEWSETELEM:
+		deleted = false
+	case unix.NFT_MSG_DELSETELEM:
+		deleted = true
+	default:
+		return nil
+	}
+
+	// msg.Data starts with a 4-byte nfgenmsg header (family, version,
+	// res_id), followed by the netlink attributes.
+	if len(msg.Data) < 4 {
+		return nil
+	}
+
+	ad, err := netlink.NewAttributeDecoder(msg.Data[4:])
+	if err != nil {
+		return nil
+	}
+	ad.ByteOrder = binary.BigEndian
+
+	var table, set string
+	var keys [][]byte
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_SET_ELEM_LIST_TABLE:
+			table = ad.String()
+		case unix.NFTA_SET_ELEM_LIST_SET:
+			set = ad.String()
+		case unix.NFTA_SET_ELEM_LIST_ELEMENTS:
+			keys = append(keys, setElemKeysFromList(ad.Bytes())...)
+		}
+	}
+
+	if ad.Err() != nil || table == "" || set == "" {
+		return nil
+	}
+
+	for _, key := range keys {
+		events = append(events, setElemEvent{
+			table:   table,
+			set:     set,
+			key:     key,
+			deleted: deleted,
+		})
+	}
+
+	return events
+}
+
+// setElemKeysFromList decodes the element keys from the raw payload of a
+// NFTA_SET_ELEM_LIST_ELEMENTS attribute, which is a list of NFTA_LIST_ELEM
+// entries.
+func setElemKeysFromList(b []byte) (keys [][]byte) {
+	ad, err := netlink.NewAttributeDecoder(b)
+	if err != nil {
+		return nil
+	}
+	ad.ByteOrder = binary.BigEndian
+
+	for ad.Next() {
+		if ad.Type() != unix.NFTA_LIST_ELEM {
+			continue
+		}
+
+		if key, ok := setElemKeyFromListElem(ad.Bytes()); ok {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// setElemKeyFromListElem decodes the NFTA_SET_ELEM_KEY attribute of a single
+// NFTA_LIST_ELEM entry.  Concatenated keys (e.g. "ipv4_addr . inet_service")
+// come back as the single raw blob nftables concatenates them into, matching
+// [nftables.SetElement.Key].
+func setElemKeyFromListElem(b []byte) (key []byte, ok bool) {
+	ad, err := netlink.NewAttributeDecoder(b)
+	if err != nil {
+		return nil, false
+	}
+	ad.ByteOrder = binary.BigEndian
+
+	for ad.Next() {
+		if ad.Type() != unix.NFTA_SET_ELEM_KEY {
+			continue
+		}
+
+		// NFTA_SET_ELEM_KEY nests a single NFTA_DATA_VALUE attribute holding
+		// the raw key bytes.  The two constants happen to share the same
+		// numeric value (1), as in nftables' own (unexported) decodeElement.
+		nad, nerr := netlink.NewAttributeDecoder(ad.Bytes())
+		if nerr != nil {
+			continue
+		}
+		nad.ByteOrder = binary.BigEndian
+
+		for nad.Next() {
+			if nad.Type() == unix.NFTA_DATA_VALUE {
+				key = nad.Bytes()
+			}
+		}
+	}
+
+	return key, key != nil
+}
@@ -0,0 +1,109 @@
+//go:build linux
+
+package ipset
+
+import (
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// encodeSetElemKey builds the nested NFTA_SET_ELEM_KEY attribute payload for
+// key, matching the layout nftables itself emits and decodes (see
+// decodeElement in the nftables package).
+func encodeSetElemKey(key []byte) (b []byte) {
+	b, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_DATA_VALUE, Data: key},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+// newSetElemMsg builds a raw NFT_MSG_NEWSETELEM/DELSETELEM netlink message
+// for table/set/keys, in the wire format emitted by the kernel, to exercise
+// [setElemEventsFromMessage] against real attribute encoding instead of a
+// hand-rolled fixture.
+func newSetElemMsg(t *testing.T, deleted bool, table, set string, keys ...[]byte) (msg netlink.Message) {
+	t.Helper()
+
+	var elems []netlink.Attribute
+	for _, key := range keys {
+		elemAttrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+			{Type: unix.NLA_F_NESTED | unix.NFTA_SET_ELEM_KEY, Data: encodeSetElemKey(key)},
+		})
+		require.NoError(t, err)
+
+		elems = append(elems, netlink.Attribute{
+			Type: unix.NLA_F_NESTED | unix.NFTA_LIST_ELEM,
+			Data: elemAttrs,
+		})
+	}
+
+	elemsData, err := netlink.MarshalAttributes(elems)
+	require.NoError(t, err)
+
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_SET_ELEM_LIST_TABLE, Data: []byte(table + "\x00")},
+		{Type: unix.NFTA_SET_ELEM_LIST_SET, Data: []byte(set + "\x00")},
+		{Type: unix.NLA_F_NESTED | unix.NFTA_SET_ELEM_LIST_ELEMENTS, Data: elemsData},
+	})
+	require.NoError(t, err)
+
+	msgType := uint16(unix.NFT_MSG_NEWSETELEM)
+	if deleted {
+		msgType = uint16(unix.NFT_MSG_DELSETELEM)
+	}
+
+	return netlink.Message{
+		Header: netlink.Header{
+			Type: netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<nfSubsysShift) | netlink.HeaderType(msgType),
+		},
+		// The first 4 bytes are the nfgenmsg header, which this parser
+		// ignores.
+		Data: append(make([]byte, 4), data...),
+	}
+}
+
+func TestSetElemEventsFromMessage(t *testing.T) {
+	t.Run("new", func(t *testing.T) {
+		msg := newSetElemMsg(t, false, "fw4", "ipv4set", []byte{1, 2, 3, 4})
+
+		events := setElemEventsFromMessage(msg)
+		require.Len(t, events, 1)
+
+		assert.Equal(t, setElemEvent{
+			table: "fw4",
+			set:   "ipv4set",
+			key:   []byte{1, 2, 3, 4},
+		}, events[0])
+	})
+
+	t.Run("delete_multiple", func(t *testing.T) {
+		msg := newSetElemMsg(t, true, "fw4", "ipv4set", []byte{1, 2, 3, 4}, []byte{5, 6, 7, 8})
+
+		events := setElemEventsFromMessage(msg)
+		require.Len(t, events, 2)
+
+		assert.Equal(t, []byte{1, 2, 3, 4}, events[0].key)
+		assert.Equal(t, []byte{5, 6, 7, 8}, events[1].key)
+		assert.True(t, events[0].deleted)
+		assert.True(t, events[1].deleted)
+	})
+
+	t.Run("unrelated_message", func(t *testing.T) {
+		msg := netlink.Message{
+			Header: netlink.Header{
+				Type: netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<nfSubsysShift) | netlink.HeaderType(unix.NFT_MSG_NEWTABLE),
+			},
+			Data: make([]byte, 4),
+		}
+
+		assert.Empty(t, setElemEventsFromMessage(msg))
+	})
+}